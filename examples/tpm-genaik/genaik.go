@@ -17,9 +17,15 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 
 	"github.com/jclab-joseph/go-tpm/tpm"
@@ -34,6 +40,9 @@ var (
 func main() {
 	var blobname = flag.String("blob", "aikblob", "The name of the file to create")
 	var tpmname = flag.String("tpm", "/dev/tpm0", "The path to the TPM device to use")
+	var pcaCert = flag.String("pca-cert", "", "Path to the Privacy CA's public key, as a PEM X.509 certificate or a raw TCPA_PUBKEY")
+	var pcaURL = flag.String("pca-url", "", "URL of a Privacy CA to submit the identity request to; the identity request blob is written to -blob either way")
+	var credOut = flag.String("cred-out", "aikcred", "The name of the file to write the recovered AIK credential to, once a Privacy CA has issued one")
 	flag.Parse()
 
 	rwc, err := tpm.OpenTPM(*tpmname)
@@ -64,8 +73,22 @@ func main() {
 		copy(aikAuth[:], aa[:])
 	}
 
-	// TODO(tmroeder): add support for Privacy CAs.
-	blob, err := tpm.MakeIdentity(rwc, srkAuth[:], ownerAuth[:], aikAuth[:], nil, nil)
+	var pcaPub *rsa.PublicKey
+	if *pcaCert != "" {
+		pcaPub, err = loadPCAPublicKey(*pcaCert)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't load the Privacy CA public key from %s: %s\n", *pcaCert, err)
+			return
+		}
+	}
+
+	// MakeIdentity signs the new AIK's public key into a TPM_IDENTITY_CONTENTS
+	// structure and, when given a Privacy CA key, builds and returns the full
+	// TPM_IDENTITY_REQ for that CA directly - it's the one place that has
+	// both the pre-signature TPM_IDENTITY_CONTENTS and the digest binding it
+	// to the AIK, which EncodeIdentityReq has no way to reconstruct on its
+	// own from the signed blob alone.
+	blob, err := tpm.MakeIdentity(rwc, srkAuth[:], ownerAuth[:], aikAuth[:], pcaPub, []byte("AIK"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Couldn't make an new AIK: %s\n", err)
 		return
@@ -76,5 +99,69 @@ func main() {
 		return
 	}
 
-	return
+	if pcaPub == nil {
+		return
+	}
+
+	if *pcaURL == "" {
+		fmt.Fprintf(os.Stderr, "Wrote the identity request for the Privacy CA to %s; pass -pca-url to submit it automatically\n", *blobname)
+		return
+	}
+
+	symAttestation, err := submitIdentityReq(*pcaURL, blob)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't submit the identity request to the Privacy CA at %s: %s\n", *pcaURL, err)
+		return
+	}
+
+	cred, err := tpm.ActivateIdentity(rwc, aikAuth[:], ownerAuth[:], symAttestation)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't activate the AIK credential: %s\n", err)
+		return
+	}
+
+	if err := os.WriteFile(*credOut, cred, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write the AIK credential to %s: %s\n", *credOut, err)
+		return
+	}
+}
+
+// loadPCAPublicKey reads a Privacy CA's public key from path, accepting
+// either a PEM-encoded X.509 certificate or a raw TCPA_PUBKEY-encoded RSA
+// key, since both forms are in common use among Privacy CA operators.
+func loadPCAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(data); block != nil {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the PCA certificate: %w", err)
+		}
+		rsaPub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("the PCA certificate's public key must be RSA")
+		}
+		return rsaPub, nil
+	}
+
+	return tpm.UnmarshalPubKey(data)
+}
+
+// submitIdentityReq POSTs the TPM_IDENTITY_REQ blob to the Privacy CA and
+// returns the TPM_SYM_CA_ATTESTATION it responds with.
+func submitIdentityReq(url string, idReq []byte) ([]byte, error) {
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(idReq))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Privacy CA returned status %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
 }
@@ -0,0 +1,429 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// ordActivateIdentity is TPM_ORD_ActivateIdentity (TPM Main Part 3,
+// section 23.4).
+const ordActivateIdentity uint32 = 0x0000007A
+
+// asymAlgorithmRSA and asymSchemeOAEPSHA1MGF1 are the only asymmetric
+// algorithm/scheme pair that this package supports for TPM_IDENTITY_REQ, as
+// required by the TPM Main Specification Part 3, section 23.3.
+const (
+	asymAlgorithmRSA       = 0x00000001
+	asymSchemeOAEPSHA1MGF1 = 0x0003
+	sigSchemeNone          = 0x0001
+	symAlgorithmAES128     = 0x00000006
+	symSchemeCBCPKCS5      = 0x0002
+)
+
+// identityReq holds a packed TPM_IDENTITY_REQ, which a Privacy CA uses to
+// recover the TPM_IDENTITY_PROOF belonging to the candidate AIK. It is
+// built by EncodeIdentityReq and is opaque to callers: it's only ever sent
+// to the Privacy CA as part of the AIK-issuance round trip.
+type identityReq struct {
+	AsymSize uint32
+	SymSize  uint32
+	AsymAlg  tpmKeyParms
+	SymAlg   tpmKeyParms
+	AsymBlob []byte
+	SymBlob  []byte
+}
+
+// tpmKeyParms is TPM_KEY_PARMS (TPM Main Part 2, section 10.2): an
+// algorithm ID plus the encryption and signature schemes it's being used
+// under, followed by an algorithm-specific, size-prefixed parms blob. Both
+// TPM_ASYM_CA_CONTENTS and TPM_SYM_CA_ATTESTATION carry one of these ahead
+// of their payload so the receiver knows how to interpret it.
+type tpmKeyParms struct {
+	AlgorithmID uint32
+	EncScheme   uint16
+	SigScheme   uint16
+	Parms       []byte
+}
+
+func (p tpmKeyParms) marshal(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, p.AlgorithmID)
+	binary.Write(buf, binary.BigEndian, p.EncScheme)
+	binary.Write(buf, binary.BigEndian, p.SigScheme)
+	binary.Write(buf, binary.BigEndian, uint32(len(p.Parms)))
+	buf.Write(p.Parms)
+}
+
+func unmarshalTPMKeyParms(b []byte) (tpmKeyParms, []byte, error) {
+	if len(b) < 12 {
+		return tpmKeyParms{}, nil, errors.New("tpm: TPM_KEY_PARMS is too short")
+	}
+	p := tpmKeyParms{
+		AlgorithmID: binary.BigEndian.Uint32(b[0:4]),
+		EncScheme:   binary.BigEndian.Uint16(b[4:6]),
+		SigScheme:   binary.BigEndian.Uint16(b[6:8]),
+	}
+	parmSize := binary.BigEndian.Uint32(b[8:12])
+	rest := b[12:]
+	if uint32(len(rest)) < parmSize {
+		return tpmKeyParms{}, nil, errors.New("tpm: TPM_KEY_PARMS parms are truncated")
+	}
+	p.Parms = rest[:parmSize]
+	return p, rest[parmSize:], nil
+}
+
+// tpmSymmetricKey is TPM_SYMMETRIC_KEY (TPM Main Part 2, section 10.5): an
+// algorithm ID and encryption scheme tag ahead of the raw key bytes, so the
+// recipient knows how to interpret data encrypted under it.
+type tpmSymmetricKey struct {
+	AlgorithmID uint32
+	EncScheme   uint16
+	Key         []byte
+}
+
+func (k tpmSymmetricKey) marshal(buf *bytes.Buffer) {
+	binary.Write(buf, binary.BigEndian, k.AlgorithmID)
+	binary.Write(buf, binary.BigEndian, k.EncScheme)
+	binary.Write(buf, binary.BigEndian, uint16(len(k.Key)))
+	buf.Write(k.Key)
+}
+
+func unmarshalTPMSymmetricKey(b []byte) (tpmSymmetricKey, []byte, error) {
+	if len(b) < 8 {
+		return tpmSymmetricKey{}, nil, errors.New("tpm: TPM_SYMMETRIC_KEY is too short")
+	}
+	k := tpmSymmetricKey{
+		AlgorithmID: binary.BigEndian.Uint32(b[0:4]),
+		EncScheme:   binary.BigEndian.Uint16(b[4:6]),
+	}
+	keySize := binary.BigEndian.Uint16(b[6:8])
+	rest := b[8:]
+	if uint16(len(rest)) < keySize {
+		return tpmSymmetricKey{}, nil, errors.New("tpm: TPM_SYMMETRIC_KEY key is truncated")
+	}
+	k.Key = rest[:keySize]
+	return k, rest[keySize:], nil
+}
+
+// asymCAContents is TPM_ASYM_CA_CONTENTS: the symmetric key and AIK digest
+// that the Privacy CA recovers from the asymmetric half of the identity
+// request, using its own private key.
+type asymCAContents struct {
+	SessionKey tpmSymmetricKey
+	IDDigest   [20]byte
+}
+
+func (c asymCAContents) marshal() []byte {
+	var buf bytes.Buffer
+	c.SessionKey.marshal(&buf)
+	buf.Write(c.IDDigest[:])
+	return buf.Bytes()
+}
+
+// unmarshalAsymCAContents unpacks a TPM_ASYM_CA_CONTENTS blob, as recovered
+// by a Privacy CA (or, in tests, by decrypting with the matching private
+// key) from the asymmetric half of a TPM_IDENTITY_REQ.
+func unmarshalAsymCAContents(b []byte) (*asymCAContents, error) {
+	sessionKey, rest, err := unmarshalTPMSymmetricKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TPM_ASYM_CA_CONTENTS: %v", err)
+	}
+	if len(rest) != 20 {
+		return nil, fmt.Errorf("tpm: TPM_ASYM_CA_CONTENTS digest is %d bytes, want 20", len(rest))
+	}
+	c := &asymCAContents{SessionKey: sessionKey}
+	copy(c.IDDigest[:], rest)
+	return c, nil
+}
+
+// symCAAttestation is TPM_SYM_CA_ATTESTATION: the blob a Privacy CA returns
+// after verifying an identity request, encrypted under the session key from
+// the matching asymCAContents so that only the TPM that generated the AIK
+// can recover it via ActivateIdentity.
+type symCAAttestation struct {
+	Algorithm  tpmKeyParms
+	Credential []byte
+}
+
+// marshal packs an identityReq into the TPM_IDENTITY_REQ wire format.
+func (r *identityReq) marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, r.AsymSize)
+	binary.Write(&buf, binary.BigEndian, r.SymSize)
+	r.AsymAlg.marshal(&buf)
+	r.SymAlg.marshal(&buf)
+	buf.Write(r.AsymBlob)
+	buf.Write(r.SymBlob)
+	return buf.Bytes()
+}
+
+// unmarshalIdentityReq unpacks a TPM_IDENTITY_REQ blob, as built by
+// EncodeIdentityReq. It's used by tests that need to inspect a request
+// after it's been built, since a real Privacy CA never needs to - it just
+// decrypts AsymBlob and SymBlob with its own keys.
+func unmarshalIdentityReq(b []byte) (*identityReq, error) {
+	if len(b) < 8 {
+		return nil, errors.New("tpm: TPM_IDENTITY_REQ blob is too short")
+	}
+	asymSize := binary.BigEndian.Uint32(b[0:4])
+	symSize := binary.BigEndian.Uint32(b[4:8])
+	asymAlg, rest, err := unmarshalTPMKeyParms(b[8:])
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TPM_IDENTITY_REQ asymAlgorithm: %v", err)
+	}
+	symAlg, rest, err := unmarshalTPMKeyParms(rest)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TPM_IDENTITY_REQ symAlgorithm: %v", err)
+	}
+	if uint32(len(rest)) < asymSize+symSize {
+		return nil, fmt.Errorf("tpm: TPM_IDENTITY_REQ blobs are truncated: got %d bytes, want %d", len(rest), asymSize+symSize)
+	}
+	return &identityReq{
+		AsymSize: asymSize,
+		SymSize:  symSize,
+		AsymAlg:  asymAlg,
+		SymAlg:   symAlg,
+		AsymBlob: rest[:asymSize],
+		SymBlob:  rest[asymSize : asymSize+symSize],
+	}, nil
+}
+
+// unmarshalSymCAAttestation unpacks a TPM_SYM_CA_ATTESTATION blob as
+// returned by a Privacy CA.
+func unmarshalSymCAAttestation(b []byte) (*symCAAttestation, error) {
+	if len(b) < 4 {
+		return nil, errors.New("tpm: TPM_SYM_CA_ATTESTATION blob is too short")
+	}
+	credSize := binary.BigEndian.Uint32(b[0:4])
+	alg, rest, err := unmarshalTPMKeyParms(b[4:])
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TPM_SYM_CA_ATTESTATION: %v", err)
+	}
+	if uint32(len(rest)) < credSize {
+		return nil, fmt.Errorf("tpm: TPM_SYM_CA_ATTESTATION credential is truncated: got %d bytes, want %d", len(rest), credSize)
+	}
+	return &symCAAttestation{
+		Algorithm:  alg,
+		Credential: rest[:credSize],
+	}, nil
+}
+
+// EncodeIdentityReq builds a TPM_IDENTITY_REQ for the Privacy CA identified
+// by pcaPub. identityProof is the TPM_IDENTITY_PROOF produced from the AIK
+// that MakeIdentity created (its public key blob, the CA's own label and
+// public key, and the TPM's signature binding the two together) - it's
+// what's symmetrically encrypted so that only a CA that can verify the
+// binding ever sees it. idContentsDigest is the SHA-1 digest of the signed
+// TPM_IDENTITY_CONTENTS that produced that binding, which the CA
+// recomputes independently to confirm the proof wasn't tampered with in
+// transit.
+func EncodeIdentityReq(pcaPub *rsa.PublicKey, identityProof []byte, idContentsDigest [20]byte) ([]byte, error) {
+	var rawSessionKey [16]byte
+	if _, err := rand.Read(rawSessionKey[:]); err != nil {
+		return nil, fmt.Errorf("tpm: couldn't generate a session key for the identity request: %v", err)
+	}
+
+	contents := asymCAContents{
+		SessionKey: tpmSymmetricKey{
+			AlgorithmID: symAlgorithmAES128,
+			EncScheme:   symSchemeCBCPKCS5,
+			Key:         rawSessionKey[:],
+		},
+		IDDigest: idContentsDigest,
+	}
+
+	asymBlob, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pcaPub, contents.marshal(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: couldn't encrypt TPM_ASYM_CA_CONTENTS for the Privacy CA: %v", err)
+	}
+
+	symBlob, err := aesCBCEncrypt(rawSessionKey[:], identityProof)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &identityReq{
+		AsymSize: uint32(len(asymBlob)),
+		SymSize:  uint32(len(symBlob)),
+		AsymAlg: tpmKeyParms{
+			AlgorithmID: asymAlgorithmRSA,
+			EncScheme:   asymSchemeOAEPSHA1MGF1,
+			SigScheme:   sigSchemeNone,
+		},
+		SymAlg: tpmKeyParms{
+			AlgorithmID: symAlgorithmAES128,
+			EncScheme:   symSchemeCBCPKCS5,
+			SigScheme:   sigSchemeNone,
+		},
+		AsymBlob: asymBlob,
+		SymBlob:  symBlob,
+	}
+	return req.marshal(), nil
+}
+
+// ActivateIdentity asks the TPM to recover the AIK credential issued by a
+// Privacy CA. symCAAttestationBlob is the TPM_SYM_CA_ATTESTATION the caller
+// received back from the CA in response to the identity request built by
+// EncodeIdentityReq; the TPM decrypts it using the private SRK so the
+// session key never leaves the chip. aikAuth and ownerAuth authorize use of
+// the AIK and the owner, respectively, exactly as in MakeIdentity.
+func ActivateIdentity(rw io.ReadWriter, aikAuth []byte, ownerAuth []byte, symCAAttestationBlob []byte) ([]byte, error) {
+	sca, err := unmarshalSymCAAttestation(symCAAttestationBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := tpmActivateIdentity(rw, aikAuth, ownerAuth, sca)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TPM_ActivateIdentity failed: %v", err)
+	}
+	return credential, nil
+}
+
+// tpmActivateIdentity issues the TPM_ActivateIdentity command. The command
+// needs two auth sessions: one proving knowledge of the AIK's usage auth
+// (OIAP, since the AIK has no shared secret to base an OSAP session on) and
+// one proving knowledge of the owner auth (OSAP, mirroring the session
+// MakeIdentity already opens for the owner).
+func tpmActivateIdentity(rw io.ReadWriter, aikAuth []byte, ownerAuth []byte, sca *symCAAttestation) ([]byte, error) {
+	aikSession, err := newOIAPSession(rw)
+	if err != nil {
+		return nil, err
+	}
+	defer aikSession.Close(rw)
+
+	ownerSession, err := newOSAPSession(rw, etOwner, khOwner, ownerAuth)
+	if err != nil {
+		return nil, err
+	}
+	defer ownerSession.Close(rw)
+
+	scaBlob := sca.marshal()
+
+	aikAuthBlock, err := newCommandAuth(aikSession.AuthHandle, aikSession.NonceEven, aikAuth, ordActivateIdentity, scaBlob)
+	if err != nil {
+		return nil, err
+	}
+	ownerAuthBlock, err := newCommandAuth(ownerSession.AuthHandle, ownerSession.NonceEven, ownerSession.SharedSecret, ordActivateIdentity, scaBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	var credential []byte
+	ra, ro, ret, err := submitTPMRequest(rw, tagRQUAuth2Command, ordActivateIdentity, []interface{}{scaBlob, aikAuthBlock, ownerAuthBlock}, []interface{}{&credential})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := aikAuthBlock.verify(ordActivateIdentity, ra, aikAuth); err != nil {
+		return nil, err
+	}
+	if err := ownerAuthBlock.verify(ordActivateIdentity, ro, ownerSession.SharedSecret); err != nil {
+		return nil, err
+	}
+	if ret != 0 {
+		return nil, fmt.Errorf("tpm: TPM_ActivateIdentity returned error code %d", ret)
+	}
+	return credential, nil
+}
+
+// marshal packs a symCAAttestation into the TPM_SYM_CA_ATTESTATION wire
+// format expected by TPM_ActivateIdentity.
+func (s *symCAAttestation) marshal() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(s.Credential)))
+	s.Algorithm.marshal(&buf)
+	buf.Write(s.Credential)
+	return buf.Bytes()
+}
+
+// aesCBCEncrypt encrypts plaintext under key using AES-CBC with PKCS#5
+// padding and a zero IV, as required for the symmetric half of a
+// TPM_IDENTITY_REQ (TPM Main Part 3, section 23.3). The IV is zero because
+// the session key itself is single-use and never reused across requests.
+func aesCBCEncrypt(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: couldn't create AES cipher for the identity request: %v", err)
+	}
+
+	padded := pkcs5Pad(plaintext, block.BlockSize())
+	ciphertext := make([]byte, len(padded))
+	iv := make([]byte, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, padded)
+	return ciphertext, nil
+}
+
+func pkcs5Pad(b []byte, blockSize int) []byte {
+	padLen := blockSize - len(b)%blockSize
+	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
+	return append(b, padding...)
+}
+
+// UnmarshalPubKey parses a raw TCPA_PUBKEY-encoded RSA key, as published by
+// some Privacy CAs instead of an X.509 certificate. The TCPA_PUBKEY format
+// is TPM_KEY_PARMS (algorithm ID, encryption scheme, signature scheme, a
+// size-prefixed algorithm-specific parms blob holding the RSA key size and
+// exponent) followed by a size-prefixed modulus (TPM Main Part 2,
+// section 10.1).
+func UnmarshalPubKey(b []byte) (*rsa.PublicKey, error) {
+	keyParms, rest, err := unmarshalTPMKeyParms(b)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: TCPA_PUBKEY: %v", err)
+	}
+	if keyParms.AlgorithmID != asymAlgorithmRSA {
+		return nil, fmt.Errorf("tpm: unsupported TCPA_PUBKEY algorithm %d", keyParms.AlgorithmID)
+	}
+	parms := keyParms.Parms
+	if len(parms) < 12 {
+		return nil, errors.New("tpm: TCPA_RSA_KEY_PARMS blob is too short")
+	}
+	exponentSize := binary.BigEndian.Uint32(parms[8:12])
+	exponentBytes := parms[12:]
+	if uint32(len(exponentBytes)) < exponentSize {
+		return nil, errors.New("tpm: TCPA_RSA_KEY_PARMS exponent is truncated")
+	}
+	exponent := 65537
+	if exponentSize > 0 {
+		exponent = 0
+		for _, b := range exponentBytes[:exponentSize] {
+			exponent = exponent<<8 | int(b)
+		}
+	}
+
+	if len(rest) < 4 {
+		return nil, errors.New("tpm: TCPA_STORE_PUBKEY is missing")
+	}
+	keySize := binary.BigEndian.Uint32(rest[0:4])
+	modulusBytes := rest[4:]
+	if uint32(len(modulusBytes)) < keySize {
+		return nil, errors.New("tpm: TCPA_STORE_PUBKEY modulus is truncated")
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulusBytes[:keySize]),
+		E: exponent,
+	}, nil
+}
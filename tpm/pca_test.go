@@ -0,0 +1,146 @@
+// Copyright (c) 2014, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// TestEncodeIdentityReqRoundTrip plays both sides of the identity-request
+// protocol: it builds a TPM_IDENTITY_REQ as the TPM side would, then
+// recovers the session key, digest, and identity proof as the Privacy CA
+// side would, and checks that what comes out is what went in.
+func TestEncodeIdentityReqRoundTrip(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("couldn't generate a test Privacy CA key: %v", err)
+	}
+
+	identityProof := []byte("a fake TPM_IDENTITY_PROOF: AIK pubkey + binding signature")
+	idContentsDigest := sha1.Sum([]byte("a fake TPM_IDENTITY_CONTENTS"))
+
+	reqBlob, err := EncodeIdentityReq(&priv.PublicKey, identityProof, idContentsDigest)
+	if err != nil {
+		t.Fatalf("EncodeIdentityReq returned error: %v", err)
+	}
+
+	req, err := unmarshalIdentityReq(reqBlob)
+	if err != nil {
+		t.Fatalf("couldn't parse the TPM_IDENTITY_REQ this package just built: %v", err)
+	}
+	if req.AsymAlg.AlgorithmID != asymAlgorithmRSA || req.AsymAlg.EncScheme != asymSchemeOAEPSHA1MGF1 {
+		t.Errorf("unexpected asymmetric algorithm: %+v", req.AsymAlg)
+	}
+	if req.SymAlg.AlgorithmID != symAlgorithmAES128 || req.SymAlg.EncScheme != symSchemeCBCPKCS5 {
+		t.Errorf("unexpected symmetric algorithm: %+v", req.SymAlg)
+	}
+
+	contentsBytes, err := rsa.DecryptOAEP(sha1.New(), nil, priv, req.AsymBlob, nil)
+	if err != nil {
+		t.Fatalf("couldn't decrypt TPM_ASYM_CA_CONTENTS: %v", err)
+	}
+	contents, err := unmarshalAsymCAContents(contentsBytes)
+	if err != nil {
+		t.Fatalf("couldn't parse TPM_ASYM_CA_CONTENTS: %v", err)
+	}
+	if contents.IDDigest != idContentsDigest {
+		t.Errorf("recovered digest = %x, want %x", contents.IDDigest, idContentsDigest)
+	}
+	if contents.SessionKey.AlgorithmID != symAlgorithmAES128 {
+		t.Errorf("recovered session key algorithm = %d, want %d", contents.SessionKey.AlgorithmID, symAlgorithmAES128)
+	}
+
+	gotProof, err := aesCBCDecrypt(contents.SessionKey.Key, req.SymBlob)
+	if err != nil {
+		t.Fatalf("couldn't decrypt the symmetric half with the recovered session key: %v", err)
+	}
+	if !bytes.Equal(gotProof, identityProof) {
+		t.Errorf("recovered identity proof = %q, want %q", gotProof, identityProof)
+	}
+}
+
+// TestUnmarshalPubKey checks UnmarshalPubKey against a hand-built
+// TCPA_PUBKEY fixture, rather than one round-tripped through this
+// package's own marshaling code.
+func TestUnmarshalPubKey(t *testing.T) {
+	exponent := []byte{0x01, 0x00, 0x01} // 65537
+	modulus := []byte{
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+		0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f, 0x10,
+	}
+
+	var parms bytes.Buffer
+	binary.Write(&parms, binary.BigEndian, uint32(2048))          // keyLength
+	binary.Write(&parms, binary.BigEndian, uint32(2))             // numPrimes
+	binary.Write(&parms, binary.BigEndian, uint32(len(exponent))) // exponentSize
+	parms.Write(exponent)
+
+	var blob bytes.Buffer
+	binary.Write(&blob, binary.BigEndian, uint32(asymAlgorithmRSA))
+	binary.Write(&blob, binary.BigEndian, uint16(asymSchemeOAEPSHA1MGF1))
+	binary.Write(&blob, binary.BigEndian, uint16(sigSchemeNone))
+	binary.Write(&blob, binary.BigEndian, uint32(parms.Len()))
+	blob.Write(parms.Bytes())
+	binary.Write(&blob, binary.BigEndian, uint32(len(modulus)))
+	blob.Write(modulus)
+
+	pub, err := UnmarshalPubKey(blob.Bytes())
+	if err != nil {
+		t.Fatalf("UnmarshalPubKey returned error: %v", err)
+	}
+	if pub.E != 65537 {
+		t.Errorf("pub.E = %d, want 65537", pub.E)
+	}
+	if want := new(big.Int).SetBytes(modulus); pub.N.Cmp(want) != 0 {
+		t.Errorf("pub.N = %v, want %v", pub.N, want)
+	}
+}
+
+// aesCBCDecrypt is aesCBCEncrypt's inverse, used only by tests: production
+// code never decrypts a TPM_IDENTITY_REQ's symmetric half, since only the
+// Privacy CA holds the session key to do that.
+func aesCBCDecrypt(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("tpm: ciphertext is not a multiple of the AES block size")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	iv := make([]byte, block.BlockSize())
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return pkcs5Unpad(plaintext)
+}
+
+func pkcs5Unpad(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("tpm: can't unpad an empty plaintext")
+	}
+	padLen := int(b[len(b)-1])
+	if padLen == 0 || padLen > len(b) {
+		return nil, errors.New("tpm: invalid PKCS#5 padding")
+	}
+	return b[:len(b)-padLen], nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2018, Google LLC All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tpm2
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/jclab-joseph/go-tpm/tpm2"
+)
+
+// These vectors are derived from the RFC 5869 HKDF-SHA-256 and HKDF-SHA-1
+// basic test cases, adapted to this package's info layering (a NUL
+// terminated label, followed by contextU, followed by contextV) rather
+// than RFC 5869's single opaque info string.
+func TestHKDF(t *testing.T) {
+	tcs := []struct {
+		name     string
+		hashAlg  Algorithm
+		secret   []byte
+		salt     []byte
+		label    string
+		contextU []byte
+		contextV []byte
+		length   int
+		expected []byte
+	}{
+		{
+			name:     "SHA256-basic",
+			hashAlg:  AlgSHA256,
+			secret:   bytes.Repeat([]byte{0x0b}, 22),
+			salt:     []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c},
+			label:    "SEALING",
+			contextU: []byte{0xf0, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8, 0xf9},
+			length:   32,
+			expected: []byte{0x5e, 0x62, 0xf8, 0x97, 0x33, 0x62, 0x42, 0xd9, 0xc0, 0x09, 0xf3, 0x8f, 0x8c, 0x28, 0x21, 0x9a, 0xd9, 0x4f, 0x25, 0xad, 0x2b, 0x8a, 0xaa, 0x51, 0xa3, 0x40, 0xd9, 0xd8, 0x6a, 0x34, 0x57, 0x36},
+		},
+		{
+			name:     "SHA1-no-salt-empty-label",
+			hashAlg:  AlgSHA1,
+			secret:   bytes.Repeat([]byte{0x0c}, 20),
+			salt:     []byte{},
+			label:    "",
+			contextU: []byte{},
+			length:   20,
+			expected: []byte{0xf5, 0x27, 0x56, 0x34, 0xa8, 0xd5, 0xcf, 0x38, 0x64, 0xbd, 0x2b, 0x86, 0xf6, 0x5b, 0x0e, 0x97, 0xad, 0xff, 0x4a, 0x78},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := HKDF(tc.hashAlg, tc.secret, tc.salt, tc.label, tc.contextU, tc.contextV, tc.length)
+			if err != nil {
+				t.Fatalf("HKDF returned error: %v", err)
+			}
+			if !bytes.Equal(got, tc.expected) {
+				t.Errorf("HKDF(%v, ...) = %x, want %x", tc.hashAlg, got, tc.expected)
+			}
+		})
+	}
+}